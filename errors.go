@@ -0,0 +1,75 @@
+package main
+
+import "net/http"
+
+// ErrorCode identifies the kind of failure a request hit, modeled on the
+// etcd v2 error taxonomy so clients can branch on a stable code instead
+// of parsing message text.
+type ErrorCode int
+
+const (
+	EcodeKeyNotFound   ErrorCode = 100
+	EcodeTestFailed    ErrorCode = 101
+	EcodeNotFile       ErrorCode = 102
+	EcodeNotDir        ErrorCode = 104
+	EcodeNodeExist     ErrorCode = 105
+	EcodeDirNotEmpty   ErrorCode = 108
+	EcodeInvalidField  ErrorCode = 209
+	EcodeRaftInternal  ErrorCode = 300
+	EcodePersistFailed ErrorCode = 301
+)
+
+// httpStatus is the HTTP status clients should expect for ec, mirroring
+// what etcd itself returns for the equivalent code.
+func (ec ErrorCode) httpStatus() int {
+	switch ec {
+	case EcodeKeyNotFound, EcodeNotDir:
+		return http.StatusNotFound
+	case EcodeNodeExist, EcodeNotFile, EcodeDirNotEmpty:
+		return http.StatusConflict
+	case EcodeTestFailed:
+		return http.StatusPreconditionFailed
+	case EcodeInvalidField:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Error is the JSON body every error response carries. Index is the
+// store's current index, filled in by ErrorHandler, not by whoever
+// constructs the Error - a failed operation has no index of its own.
+type Error struct {
+	Code    ErrorCode `json:"errorCode"`
+	Message string    `json:"message"`
+	Cause   string    `json:"cause,omitempty"`
+	Index   uint64    `json:"index"`
+}
+
+func (e *Error) Error() string {
+	if e.Cause == "" {
+		return e.Message
+	}
+	return e.Message + ": " + e.Cause
+}
+
+func newError(code ErrorCode, message, cause string) *Error {
+	return &Error{Code: code, Message: message, Cause: cause}
+}
+
+// genericErrorCode picks a reasonable ErrorCode for call sites that only
+// have a bare status and an unstructured error, e.g. a JSON decode
+// failure or a clustering precondition that isn't part of the CRUD
+// error taxonomy.
+func genericErrorCode(status int) ErrorCode {
+	switch status {
+	case http.StatusNotFound:
+		return EcodeKeyNotFound
+	case http.StatusConflict:
+		return EcodeNodeExist
+	case http.StatusBadRequest:
+		return EcodeInvalidField
+	default:
+		return EcodeRaftInternal
+	}
+}
@@ -2,26 +2,231 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/julienschmidt/httprouter"
 )
 
 type Node struct {
-	Value    interface{}
-	Children map[string]*Node
+	Value         interface{}
+	Children      map[string]*Node
+	CreatedIndex  uint64     `json:"createdIndex,omitempty"`
+	ModifiedIndex uint64     `json:"modifiedIndex,omitempty"`
+	TTL           int64      `json:"ttl,omitempty"`
+	Expiration    *time.Time `json:"expiration,omitempty"`
+}
+
+// EventAction identifies what kind of mutation produced a watch Event.
+type EventAction string
+
+const (
+	ActionCreate EventAction = "create"
+	ActionUpdate EventAction = "update"
+	ActionDelete EventAction = "delete"
+	ActionExpire EventAction = "expire"
+)
+
+// Event describes a single mutation of the config tree, delivered to
+// watchers of the path (or one of its ancestors, for recursive watches).
+type Event struct {
+	Action   EventAction `json:"action"`
+	Path     string      `json:"-"`
+	Node     *Node       `json:"node,omitempty"`
+	PrevNode *Node       `json:"prevNode,omitempty"`
+	Index    uint64      `json:"-"`
+}
+
+// watcher is a single pending subscription registered via Watch.
+type watcher struct {
+	path      string
+	recursive bool
+	ch        chan Event
+}
+
+// maxEventHistory bounds the ring buffer of recent events kept so that
+// waitIndex can replay events the caller may have missed.
+const maxEventHistory = 1000
+
+// expireCheckInterval controls how often the background goroutine started
+// by Start walks the TTL registry looking for expired nodes.
+const expireCheckInterval = time.Second
+
+// ttlEntry tracks a node that was created or updated with a TTL, so the
+// background expirer can find and remove it without re-walking the whole
+// tree. parent is nil for the root node.
+type ttlEntry struct {
+	path   string
+	parent *Node
+	name   string
+	node   *Node
 }
 
 type ConfigServer struct {
-	Root *Node
+	Root   *Node
+	Router *httprouter.Router
+
+	mu         sync.Mutex // guards Root, index, ttlEntries and peerHTTP
+	index      uint64
+	ttlEntries []*ttlEntry
+
+	watchMu  sync.Mutex
+	watchers []*watcher
+	history  []Event
+
+	// persistence, see persist.go; dataDir == "" means persistence is
+	// disabled (e.g. in tests)
+	dataDir                string
+	snapshotCount          int
+	walFile                *os.File
+	mutationsSinceSnapshot int
+
+	// clustering, see raft.go; raft == nil means the server runs
+	// standalone (e.g. in tests)
+	raft     *raft.Raft
+	name     string
+	peerHTTP map[raft.ServerAddress]string
+}
+
+// ErrorHandler writes a JSON error response: {errorCode, message, cause,
+// index}. err can be a *Error for a specific code/cause, or any other
+// error, in which case a reasonable code is guessed from status.
+func (cs *ConfigServer) ErrorHandler(w http.ResponseWriter, status int, err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = newError(genericErrorCode(status), err.Error(), "")
+	}
+
+	cs.mu.Lock()
+	e.Index = cs.index
+	cs.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// checkPrecondition validates the prevValue/prevIndex/prevExist query
+// parameters (if present) against node, which may be nil if the node does
+// not currently exist. cs.mu must be held by the caller.
+func checkPrecondition(node *Node, query map[string][]string) (ok bool, message string) {
+	get := func(key string) string {
+		if v, present := query[key]; present && len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	if prevExist := get("prevExist"); prevExist != "" {
+		exists := node != nil
+		if prevExist == "true" && !exists {
+			return false, "Key not found"
+		}
+		if prevExist == "false" && exists {
+			return false, "Key already exists"
+		}
+	}
+
+	if prevValue := get("prevValue"); prevValue != "" {
+		if node == nil || fmt.Sprintf("%v", node.Value) != prevValue {
+			return false, "Compare failed: prevValue mismatch"
+		}
+	}
+
+	if prevIndexStr := get("prevIndex"); prevIndexStr != "" {
+		prevIndex, err := strconv.ParseUint(prevIndexStr, 10, 64)
+		if err != nil {
+			return false, "Invalid prevIndex"
+		}
+		if node == nil || node.ModifiedIndex != prevIndex {
+			return false, "Compare failed: prevIndex mismatch"
+		}
+	}
+
+	return true, ""
 }
 
-// general error handler to save repeating code
-func (cs *ConfigServer) ErrorHandler(w http.ResponseWriter, code int, err error) {
-	w.WriteHeader(code)
-	fmt.Fprintf(w, "Error: %s\n", err)
+// parseTTL reads the optional ttl query parameter (seconds) and returns
+// the duration it represents, or zero if ttl wasn't given.
+func parseTTL(query map[string][]string) (time.Duration, error) {
+	v, present := query["ttl"]
+	if !present || len(v) == 0 || v[0] == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseInt(v[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl %q", v[0])
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// applyTTL sets node.TTL/Expiration for a non-zero ttl, or clears them if
+// ttl is zero.
+func applyTTL(node *Node, ttl time.Duration) {
+	if ttl <= 0 {
+		node.TTL = 0
+		node.Expiration = nil
+		return
+	}
+	expiration := time.Now().Add(ttl)
+	node.TTL = int64(ttl / time.Second)
+	node.Expiration = &expiration
+}
+
+// clearTTLLocked removes any registered TTL entry for path. cs.mu must be
+// held by the caller.
+func (cs *ConfigServer) clearTTLLocked(configPath string) {
+	remaining := cs.ttlEntries[:0]
+	for _, e := range cs.ttlEntries {
+		if e.path != configPath {
+			remaining = append(remaining, e)
+		}
+	}
+	cs.ttlEntries = remaining
+}
+
+// registerTTLLocked records node as having a TTL so the background
+// expirer can find it later. cs.mu must be held by the caller.
+func (cs *ConfigServer) registerTTLLocked(configPath string, parent *Node, name string, node *Node) {
+	cs.clearTTLLocked(configPath)
+	if node.Expiration != nil {
+		cs.ttlEntries = append(cs.ttlEntries, &ttlEntry{path: configPath, parent: parent, name: name, node: node})
+	}
+}
+
+// rebuildTTLEntriesLocked recomputes cs.ttlEntries from scratch by walking
+// the tree for nodes with a non-nil Expiration. applyCommand only ever
+// registers a TTL as part of a live create/update/refresh, so anything
+// that sets cs.Root by another means - WAL/snapshot replay in
+// loadFromDisk, raft's fsm.Restore - must call this afterwards, or a
+// TTL'd key silently stops expiring (including one that already expired
+// while the server was down) until it's next written to. Callers that run
+// after the server starts serving requests (fsm.Restore) must hold cs.mu;
+// loadFromDisk runs before that and needs no lock.
+func (cs *ConfigServer) rebuildTTLEntriesLocked() {
+	cs.ttlEntries = nil
+	var walk func(parent *Node, name, configPath string, node *Node)
+	walk = func(parent *Node, name, configPath string, node *Node) {
+		if node == nil {
+			return
+		}
+		if node.Expiration != nil {
+			cs.ttlEntries = append(cs.ttlEntries, &ttlEntry{path: configPath, parent: parent, name: name, node: node})
+		}
+		for childName, child := range node.Children {
+			walk(node, childName, path.Join(configPath, childName), child)
+		}
+	}
+	walk(nil, "", "", cs.Root)
 }
 
 /*
@@ -51,6 +256,186 @@ func (cs *ConfigServer) FindNode(config string) (*Node, error) {
 	}
 }
 
+// applyCommand performs the tree mutation described by cmd and returns the
+// outcome. It is the single place Create, Update and Delete touch the
+// tree - whether invoked directly in standalone mode or via the raft FSM
+// once clustering is enabled - so every code path produces identical WAL
+// entries and watch events. cs.mu must not be held by the caller.
+func (cs *ConfigServer) applyCommand(cmd raftCommand) *applyResult {
+	cs.mu.Lock()
+
+	parentConfig, name := "", ""
+	var parent *Node
+	var err error
+	if cmd.Path != "" {
+		parentConfig, name = path.Split(cmd.Path)
+		parent, err = cs.FindNode(parentConfig)
+	}
+
+	var current *Node
+	if cmd.Path == "" {
+		current = cs.Root
+	} else if err == nil {
+		current = parent.Children[name]
+	}
+
+	query := map[string][]string{}
+	if cmd.PrevValue != "" {
+		query["prevValue"] = []string{cmd.PrevValue}
+	}
+	if cmd.PrevIndex != 0 {
+		query["prevIndex"] = []string{strconv.FormatUint(cmd.PrevIndex, 10)}
+	}
+	if cmd.PrevExist != nil {
+		query["prevExist"] = []string{strconv.FormatBool(*cmd.PrevExist)}
+	}
+
+	result := &applyResult{}
+
+	switch cmd.Op {
+	case ActionDelete:
+		if err != nil {
+			result.Err = newError(EcodeKeyNotFound, "Key not found", parentConfig)
+			break
+		}
+		if current == nil {
+			result.Err = newError(EcodeKeyNotFound, "Key not found", cmd.Path)
+			break
+		}
+		if ok, message := checkPrecondition(current, query); !ok {
+			result.Err = newError(EcodeTestFailed, message, cmd.Path)
+			break
+		}
+		result.PrevNode = current
+		cs.index++
+		result.Index = cs.index
+		if cmd.Path == "" {
+			cs.Root = nil
+		} else {
+			delete(parent.Children, name)
+		}
+		cs.clearTTLLocked(cmd.Path)
+		if err := cs.appendWAL(ActionDelete, cmd.Path, nil, 0); err != nil {
+			result.Err = newError(EcodePersistFailed, "failed to persist mutation", err.Error())
+			break
+		}
+
+	default: // create or update
+		if cmd.Path != "" && err != nil {
+			result.Err = newError(EcodeKeyNotFound, "Key not found", parentConfig)
+			break
+		}
+		if ok, message := checkPrecondition(current, query); !ok {
+			switch {
+			case cmd.PrevExist != nil && *cmd.PrevExist && current == nil:
+				result.Err = newError(EcodeKeyNotFound, "Key not found", cmd.Path)
+			case cmd.PrevExist != nil && !*cmd.PrevExist && current != nil && len(current.Children) > 0:
+				result.Err = newError(EcodeNotFile, "Not a file", cmd.Path)
+			case cmd.PrevExist != nil && !*cmd.PrevExist && current != nil:
+				result.Err = newError(EcodeNodeExist, "Key already exists", cmd.Path)
+			default:
+				result.Err = newError(EcodeTestFailed, message, cmd.Path)
+			}
+			break
+		}
+
+		if cmd.Refresh {
+			if current == nil {
+				result.Err = newError(EcodeKeyNotFound, "Key not found", cmd.Path)
+				break
+			}
+			applyTTL(current, time.Duration(cmd.TTL)*time.Second)
+			cs.registerTTLLocked(cmd.Path, parent, name, current)
+			if err := cs.appendWAL(cmd.Op, cmd.Path, current.Value, current.TTL); err != nil {
+				result.Err = newError(EcodePersistFailed, "failed to persist mutation", err.Error())
+				break
+			}
+			result.Node = current
+			result.Index = current.ModifiedIndex
+			break
+		}
+
+		node := &Node{Value: cmd.Value, Children: map[string]*Node{}}
+		cs.index++
+		result.Index = cs.index
+		if current != nil {
+			node.CreatedIndex = current.CreatedIndex
+		} else {
+			node.CreatedIndex = cs.index
+		}
+		node.ModifiedIndex = cs.index
+		applyTTL(node, time.Duration(cmd.TTL)*time.Second)
+
+		if cmd.Path == "" {
+			cs.Root = node
+		} else {
+			parent.Children[name] = node
+		}
+		cs.registerTTLLocked(cmd.Path, parent, name, node)
+		if err := cs.appendWAL(cmd.Op, cmd.Path, node.Value, node.TTL); err != nil {
+			result.Err = newError(EcodePersistFailed, "failed to persist mutation", err.Error())
+			break
+		}
+
+		result.PrevNode = current
+		result.Node = node
+	}
+
+	if result.Err == nil && !cmd.Refresh {
+		cs.notify(cmd.Op, cmd.Path, result.Node, result.PrevNode, cs.index)
+	}
+	cs.mu.Unlock()
+
+	return result
+}
+
+// mutate runs cmd through the raft cluster (proposing a log entry and
+// waiting for it to commit) if clustering is enabled, or applies it
+// directly otherwise, then translates the outcome into an HTTP response.
+// Followers redirect the client to the current leader instead of
+// proposing, since only the leader's Apply is guaranteed to commit.
+func (cs *ConfigServer) mutate(w http.ResponseWriter, r *http.Request, cmd raftCommand) {
+	query := r.URL.Query()
+	cmd.PrevValue = query.Get("prevValue")
+	if v := query.Get("prevIndex"); v != "" {
+		prevIndex, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			cs.ErrorHandler(w, http.StatusBadRequest, err)
+			return
+		}
+		cmd.PrevIndex = prevIndex
+	}
+	if query.Get("prevExist") == "true" {
+		exists := true
+		cmd.PrevExist = &exists
+	} else if query.Get("prevExist") == "false" {
+		exists := false
+		cmd.PrevExist = &exists
+	}
+
+	var result *applyResult
+	if cs.raft != nil {
+		if cs.raft.State() != raft.Leader {
+			cs.redirectToLeader(w, r)
+			return
+		}
+		proposed, err := cs.propose(cmd)
+		if err != nil {
+			cs.redirectToLeader(w, r)
+			return
+		}
+		result = proposed
+	} else {
+		result = cs.applyCommand(cmd)
+	}
+
+	if result.Err != nil {
+		cs.ErrorHandler(w, result.Err.Code.httpStatus(), result.Err)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
 /*
  * Create: CRUD function to handle creating new node, will fail if node already exists
  * takes:
@@ -61,36 +446,32 @@ func (cs *ConfigServer) FindNode(config string) (*Node, error) {
  *   404 if parent node is not found
  *   409 if node already exists
  */
-func (cs *ConfigServer) Create(w http.ResponseWriter, r *http.Request) {
-	config := r.URL.Path[1:]
+func (cs *ConfigServer) Create(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	config := strings.TrimPrefix(ps.ByName("config"), "/")
 	node := new(Node)
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(node)
 
 	if err != nil {
 		cs.ErrorHandler(w, http.StatusBadRequest, err)
-	} else if config == "" { // creating root node so we can't find a parent
-		if cs.Root != nil {
-			cs.ErrorHandler(w, http.StatusConflict, err)
-		} else {
-			cs.Root = node
-			w.WriteHeader(http.StatusOK)
-		}
-	} else {
-		config, name := path.Split(config)
-		parent, err := cs.FindNode(config)
+		return
+	}
 
-		if err != nil {
-			cs.ErrorHandler(w, http.StatusNotFound, err)
-		} else {
-			if parent.Children[name] != nil {
-				cs.ErrorHandler(w, http.StatusConflict, err)
-			} else {
-				parent.Children[name] = node
-				w.WriteHeader(http.StatusOK)
-			}
-		}
+	ttlDuration, err := parseTTL(r.URL.Query())
+	if err != nil {
+		cs.ErrorHandler(w, http.StatusBadRequest, err)
+		return
 	}
+
+	notExist := false
+	cmd := raftCommand{
+		Op:        ActionCreate,
+		Path:      config,
+		Value:     node.Value,
+		TTL:       int64(ttlDuration / time.Second),
+		PrevExist: &notExist,
+	}
+	cs.mutate(w, r, cmd)
 }
 
 /*
@@ -102,16 +483,40 @@ func (cs *ConfigServer) Create(w http.ResponseWriter, r *http.Request) {
  *   400 if unknown error
  *   404 if node is not found
  */
-func (cs *ConfigServer) Read(w http.ResponseWriter, r *http.Request) {
-	log.Printf("request URL: %v", r.URL)
-	config := r.URL.Path[1:]
-	node, err := cs.FindNode(config)
+func (cs *ConfigServer) Read(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if r.URL.Query().Get("wait") == "true" {
+		cs.Watch(w, r, ps)
+		return
+	}
 
-	if err != nil {
-		cs.ErrorHandler(w, http.StatusNotFound, err)
-	} else {
-		encoder := json.NewEncoder(w)
-		encoder.Encode(node)
+	if r.URL.Query().Get("consistent") == "true" && cs.raft != nil {
+		if err := cs.raft.VerifyLeader().Error(); err != nil {
+			cs.redirectToLeader(w, r)
+			return
+		}
+	}
+
+	config := strings.TrimPrefix(ps.ByName("config"), "/")
+
+	cs.mu.Lock()
+	node, findErr := cs.FindNode(config)
+	var body []byte
+	var marshalErr error
+	if findErr == nil {
+		// Marshal while still holding cs.mu: node.Children is a live map a
+		// concurrent Create/Update/Delete mutates under the same lock, so
+		// encoding it after unlocking can race a write and panic.
+		body, marshalErr = json.Marshal(node)
+	}
+	cs.mu.Unlock()
+
+	switch {
+	case findErr != nil:
+		cs.ErrorHandler(w, EcodeKeyNotFound.httpStatus(), newError(EcodeKeyNotFound, "Key not found", config))
+	case marshalErr != nil:
+		cs.ErrorHandler(w, http.StatusInternalServerError, marshalErr)
+	default:
+		w.Write(body)
 	}
 }
 
@@ -124,35 +529,39 @@ func (cs *ConfigServer) Read(w http.ResponseWriter, r *http.Request) {
  *   400 if unknown error
  *   404 if node is not found
  */
-func (cs *ConfigServer) Update(w http.ResponseWriter, r *http.Request) {
-	config := r.URL.Path[1:]
+func (cs *ConfigServer) Update(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	config := strings.TrimPrefix(ps.ByName("config"), "/")
+	query := r.URL.Query()
+	refresh := query.Get("refresh") == "true" && query.Get("prevExist") == "true"
+
 	node := new(Node)
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(node)
+	if !refresh {
+		// A refresh only resets the TTL of the existing value, so - unlike
+		// a normal update - it's specified to take no body; real clients
+		// send none.
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(node); err != nil {
+			cs.ErrorHandler(w, http.StatusBadRequest, err)
+			return
+		}
+	}
 
+	ttlDuration, err := parseTTL(query)
 	if err != nil {
 		cs.ErrorHandler(w, http.StatusBadRequest, err)
-	} else if config == "" {  // updating root node so we can't find a parent
-		if cs.Root == nil {
-			cs.ErrorHandler(w, http.StatusNotFound, err)
-		} else {
-			cs.Root = node
-			w.WriteHeader(http.StatusOK)
-		}
-	} else {
-		config, name := path.Split(config)
-		parent, err := cs.FindNode(config)
+		return
+	}
 
-		if err != nil {
-			cs.ErrorHandler(w, http.StatusNotFound, err)
-		} else if parent.Children[name] == nil {
-			cs.ErrorHandler(w, http.StatusNotFound, err)
-		} else {
-			delete(parent.Children, name)
-			parent.Children[name] = node
-			w.WriteHeader(http.StatusOK)
-		}
+	mustExist := true
+	cmd := raftCommand{
+		Op:        ActionUpdate,
+		Path:      config,
+		Value:     node.Value,
+		TTL:       int64(ttlDuration / time.Second),
+		Refresh:   refresh,
+		PrevExist: &mustExist,
 	}
+	cs.mutate(w, r, cmd)
 }
 
 /*
@@ -164,81 +573,232 @@ func (cs *ConfigServer) Update(w http.ResponseWriter, r *http.Request) {
  *   400 if unknown error
  *   404 if node is not found
  */
-func (cs *ConfigServer) Delete(w http.ResponseWriter, r *http.Request) {
-	config := r.URL.Path[1:]
+func (cs *ConfigServer) Delete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	config := strings.TrimPrefix(ps.ByName("config"), "/")
+	cmd := raftCommand{Op: ActionDelete, Path: config}
+	cs.mutate(w, r, cmd)
+}
 
-	if config == "" {
-		cs.Root = nil
-		w.WriteHeader(http.StatusOK)
-	} else {
-		config, name := path.Split(config)
-		parent, err := cs.FindNode(config)
+/*
+ * Watch: blocks until the node at config (or, if recursive=true, any of its
+ * descendants) is created, updated or deleted, then streams a single JSON
+ * Event and returns. If waitIndex is given, events already in the history
+ * buffer with Index >= waitIndex are replayed immediately instead of
+ * blocking. If stream=true the connection is kept open and every
+ * subsequent matching event is written as newline-delimited JSON until the
+ * client disconnects.
+ */
+func (cs *ConfigServer) Watch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query := r.URL.Query()
+	config := strings.TrimPrefix(ps.ByName("config"), "/")
+	recursive := query.Get("recursive") == "true"
+	stream := query.Get("stream") == "true"
+	encoder := json.NewEncoder(w)
 
+	var waitIndex uint64
+	hasWaitIndex := false
+	if waitIndexStr := query.Get("waitIndex"); waitIndexStr != "" {
+		var err error
+		waitIndex, err = strconv.ParseUint(waitIndexStr, 10, 64)
 		if err != nil {
-			cs.ErrorHandler(w, http.StatusNotFound, err)
-		} else {
-			if parent.Children[name] == nil {
-				cs.ErrorHandler(w, http.StatusNotFound, err)
-			} else {
-				delete(parent.Children, name)
-				w.WriteHeader(http.StatusOK)
+			cs.ErrorHandler(w, http.StatusBadRequest, err)
+			return
+		}
+		hasWaitIndex = true
+	}
+
+	event, ch, replayed := cs.replayOrSubscribe(config, recursive, waitIndex, hasWaitIndex)
+	if replayed {
+		encoder.Encode(event)
+		return
+	}
+	defer cs.unsubscribe(ch)
+
+	flusher, canFlush := w.(http.Flusher)
+	if stream && canFlush {
+		for {
+			select {
+			case event := <-ch:
+				encoder.Encode(event)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
 			}
 		}
 	}
+
+	select {
+	case event := <-ch:
+		encoder.Encode(event)
+	case <-r.Context().Done():
+	}
 }
 
-func (cs *ConfigServer) Handle(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "PUT":
-		cs.Create(w, r)
-	case "POST":
-		cs.Update(w, r)
-	case "DELETE":
-		cs.Delete(w, r)
-	default:
-		cs.Read(w, r)
+// unsubscribe removes the watcher owning ch, if it is still registered.
+func (cs *ConfigServer) unsubscribe(ch chan Event) {
+	cs.watchMu.Lock()
+	defer cs.watchMu.Unlock()
+
+	for i, w := range cs.watchers {
+		if w.ch == ch {
+			cs.watchers = append(cs.watchers[:i], cs.watchers[i+1:]...)
+			return
+		}
 	}
 }
 
+// replayOrSubscribe looks for a buffered event matching config (and its
+// descendants, if recursive) with Index >= waitIndex, and registers a new
+// watcher if none is found - in the same watchMu critical section, so a
+// matching mutation can't land in the gap between the history check and
+// subscribing and be missed by both.
+func (cs *ConfigServer) replayOrSubscribe(config string, recursive bool, waitIndex uint64, hasWaitIndex bool) (event Event, ch chan Event, replayed bool) {
+	cs.watchMu.Lock()
+	defer cs.watchMu.Unlock()
+
+	if hasWaitIndex {
+		for _, event := range cs.history {
+			if event.Index >= waitIndex && matchesWatch(event.Path, config, recursive) {
+				return event, nil, true
+			}
+		}
+	}
+
+	ch = make(chan Event, 16)
+	cs.watchers = append(cs.watchers, &watcher{path: config, recursive: recursive, ch: ch})
+	return Event{}, ch, false
+}
+
+// notify records a mutation and fans it out to every watcher whose path
+// matches. The caller must already have bumped cs.index and passes the
+// resulting value so events are ordered the same way as
+// CreatedIndex/ModifiedIndex. It must be called with cs.mu still held, so
+// that history is always appended in index order even when two mutations
+// race to unlock - and without cs.watchMu held.
+func (cs *ConfigServer) notify(action EventAction, configPath string, node, prevNode *Node, index uint64) {
+	cs.watchMu.Lock()
+	defer cs.watchMu.Unlock()
+
+	event := Event{Action: action, Path: configPath, Node: node, PrevNode: prevNode, Index: index}
+
+	cs.history = append(cs.history, event)
+	if len(cs.history) > maxEventHistory {
+		cs.history = cs.history[len(cs.history)-maxEventHistory:]
+	}
+
+	for _, w := range cs.watchers {
+		if matchesWatch(configPath, w.path, w.recursive) {
+			select {
+			case w.ch <- event:
+			default:
+				// The watcher's buffer (size 16, see replayOrSubscribe) is
+				// full, meaning it's falling behind
+				// or already gone. Blocking here would stall every other
+				// mutation and watcher behind one slow client, which is
+				// worse than that one client missing an event - it can
+				// still recover by reconnecting with waitIndex set to the
+				// last index it saw, which replays from history.
+			}
+		}
+	}
+}
+
+// matchesWatch reports whether a mutation at mutated should wake a watcher
+// registered on watched.
+func matchesWatch(mutated, watched string, recursive bool) bool {
+	mutated = strings.Trim(mutated, "/")
+	watched = strings.Trim(watched, "/")
+
+	if mutated == watched {
+		return true
+	}
+	if recursive && strings.HasPrefix(mutated, watched+"/") {
+		return true
+	}
+	return false
+}
+
+// expireLoop walks the TTL registry on a ticker, removing nodes whose
+// Expiration has passed and notifying watchers with action "expire" -
+// the standard ephemeral-key pattern for service registration and
+// heartbeat-based leader election.
+func (cs *ConfigServer) expireLoop() {
+	ticker := time.NewTicker(expireCheckInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		cs.expireOnce(now)
+	}
+}
+
+func (cs *ConfigServer) expireOnce(now time.Time) {
+	cs.mu.Lock()
+
+	var expired []*ttlEntry
+	remaining := cs.ttlEntries[:0]
+	for _, e := range cs.ttlEntries {
+		if e.node.Expiration != nil && !e.node.Expiration.After(now) {
+			expired = append(expired, e)
+		} else {
+			remaining = append(remaining, e)
+		}
+	}
+	cs.ttlEntries = remaining
+
+	for _, e := range expired {
+		cs.index++
+		if e.parent == nil {
+			cs.Root = nil
+		} else {
+			delete(e.parent.Children, e.name)
+		}
+		if err := cs.appendWAL(ActionExpire, e.path, nil, 0); err != nil {
+			// No client is waiting on an expiry, so there's no response to
+			// fail - but this still means the removal that already
+			// happened in memory above isn't durable, same as any other
+			// appendWAL failure.
+			log.Printf("persisting expiry of %s: %v", e.path, err)
+		}
+		cs.notify(ActionExpire, e.path, nil, e.node, cs.index)
+	}
+
+	cs.mu.Unlock()
+}
+
 /*
  * Start: run the damn thing
  */
 func (cs *ConfigServer) Start() {
-	/*
-	cs.Router.PUT("/*config", cs.Create)
-	cs.Router.GET("/*config", cs.Read)
-	cs.Router.POST("/*config", cs.Update)
-	cs.Router.DELETE("/*config", cs.Delete)*/
+	cs.Router = cs.buildRouter()
 
-	http.HandleFunc("/", cs.Handle)
-	http.ListenAndServe(":8080", nil)
+	go cs.expireLoop()
+
+	http.ListenAndServe(":8080", cs.Router)
 }
 
+var (
+	dataDir       = flag.String("data-dir", "data", "directory for the snapshot and write-ahead log")
+	snapshotCount = flag.Int("snapshot-count", 10000, "number of mutations between automatic snapshots")
+
+	name          = flag.String("name", "node1", "this node's unique raft server ID")
+	listenPeerURL = flag.String("listen-peer-urls", "127.0.0.1:9000", "address this node's raft transport listens on")
+	peersFlag     = flag.String("peers", "", "comma-separated id=raftAddr=httpAddr entries for the rest of the cluster")
+)
+
 func main() {
-	child := &Node {
-		Value: 1234567890,
-		Children: map[string]*Node {
-			"test1child2": &Node {
-				Value: []string{"test","testing"},
-			},
-		},
-	}
-
-	root := &Node {
-		Value: "root val",
-		Children: map[string]*Node {
-			"child1": &Node {
-				Value: "I'm a child",
-				Children: map[string]*Node {
-					"child2": child,
-				},
-			},
-		},
-	}
-
-	// Lets just make a dumb fake root to test with
-	server := ConfigServer {
-		Root: root,
+	flag.Parse()
+
+	server := &ConfigServer{}
+	if err := server.OpenStore(*dataDir, *snapshotCount); err != nil {
+		log.Fatalf("opening store: %s", err)
+	}
+
+	peers, err := parsePeers(*peersFlag)
+	if err != nil {
+		log.Fatalf("parsing -peers: %s", err)
+	}
+	if err := server.StartRaft(*name, *listenPeerURL, peers, *dataDir); err != nil {
+		log.Fatalf("starting raft: %s", err)
 	}
 
 	server.Start()
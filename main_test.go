@@ -2,77 +2,518 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
 )
 
-var test_child = &Node {
-	Value: 12345,
-	Children: map[string]*Node {
-		"test1child2": &Node {
-			Value: []string{"test","testing"},
+// newTestServer builds a standalone ConfigServer (no raft, no dataDir) with
+// a small fixed tree to exercise the CRUD handlers against.
+func newTestServer() *ConfigServer {
+	return &ConfigServer{
+		Root: &Node{
+			Value: "root val",
+			Children: map[string]*Node{
+				"child1": {
+					Value: "I'm a child",
+					Children: map[string]*Node{
+						"child2": {
+							Value:    12345,
+							Children: map[string]*Node{},
+						},
+					},
+				},
+			},
 		},
-	},
+	}
 }
 
-var test_root = &Node {
-	Value: "root val",
-	Children: map[string]*Node {
-		"child1": &Node {
-			Value: "I'm a child",
-			Children: map[string]*Node {
-				"child2": test_child,
-			},
-		},
-	},
+// doRequest drives a handler directly, the way buildRouter's httprouter
+// would dispatch it, without needing an actual listener.
+func doRequest(cs *ConfigServer, method, config string, body interface{}) *httptest.ResponseRecorder {
+	return doRequestQuery(cs, method, config, "", body)
+}
+
+// doRequestQuery is doRequest with a raw query string (e.g.
+// "prevValue=old&ttl=30") appended to the request URL.
+func doRequestQuery(cs *ConfigServer, method, config, query string, body interface{}) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		encoded, _ := json.Marshal(body)
+		reader = bytes.NewReader(encoded)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	url := "/v2/keys/" + config
+	if query != "" {
+		url += "?" + query
+	}
+	r := httptest.NewRequest(method, url, reader)
+	w := httptest.NewRecorder()
+	ps := httprouter.Params{{Key: "config", Value: "/" + config}}
+
+	switch method {
+	case http.MethodPut:
+		cs.Create(w, r, ps)
+	case http.MethodGet:
+		cs.Read(w, r, ps)
+	case http.MethodPost:
+		cs.Update(w, r, ps)
+	case http.MethodDelete:
+		cs.Delete(w, r, ps)
+	}
+	return w
+}
+
+// decodeError unmarshals an error response body, failing the test if it
+// isn't the structured {errorCode, message, ...} shape ErrorHandler writes.
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) *Error {
+	t.Helper()
+	var e Error
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatalf("decoding error body: %v", err)
+	}
+	return &e
 }
 
 func TestCreate(t *testing.T) {
-	enc_root, _ := json.Marshal(test_root)
-	code := Create("", bytes.NewReader(enc_root))
-	if code != http.StatusOK {
-		t.Fail()
+	cs := newTestServer()
+
+	w := doRequest(cs, http.MethodPut, "newkey", map[string]interface{}{"value": "hello"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// Creating the same key again must fail with the node-exists code, not
+	// just a generic 409.
+	w = doRequest(cs, http.MethodPut, "newkey", map[string]interface{}{"value": "hello"})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if e := decodeError(t, w); e.Code != EcodeNodeExist {
+		t.Errorf("got errorCode %d, want %d", e.Code, EcodeNodeExist)
 	}
 }
 
 func TestRead(t *testing.T) {
-	// Test reading root
-	_, code := Read("")
-	if code != http.StatusOK {
-		t.Fail()
+	cs := newTestServer()
+
+	w := doRequest(cs, http.MethodGet, "child1/child2", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
 	}
 
-	// Test reading a node
-	_, code = Read("child1/child2")
-	if code != http.StatusOK {
-		t.Fail()
+	w = doRequest(cs, http.MethodGet, "nosuchkey", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if e := decodeError(t, w); e.Code != EcodeKeyNotFound {
+		t.Errorf("got errorCode %d, want %d", e.Code, EcodeKeyNotFound)
 	}
 }
 
 func TestDelete(t *testing.T) {
-	// Test deleting a node
-	code := Delete("child1/child2")
+	cs := newTestServer()
+
+	w := doRequest(cs, http.MethodDelete, "child1/child2", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
 
-	if code != http.StatusOK {
-		t.Fail()
+	w = doRequest(cs, http.MethodGet, "child1/child2", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusNotFound)
 	}
 
-	_, code = Read("child1/child2")
-	if code != http.StatusNotFound {
-		t.Fail()
+	// Deleting it a second time must fail with the key-not-found code.
+	w = doRequest(cs, http.MethodDelete, "child1/child2", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if e := decodeError(t, w); e.Code != EcodeKeyNotFound {
+		t.Errorf("got errorCode %d, want %d", e.Code, EcodeKeyNotFound)
 	}
 }
 
+// TestUpdateRefresh pins down that a TTL refresh takes no body - real
+// clients send none, only the query parameters.
+func TestUpdateRefresh(t *testing.T) {
+	cs := newTestServer()
+
+	w := doRequestQuery(cs, http.MethodPost, "child1/child2", "refresh=true&prevExist=true&ttl=30", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	w = doRequest(cs, http.MethodGet, "child1/child2", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var node Node
+	if err := json.Unmarshal(w.Body.Bytes(), &node); err != nil {
+		t.Fatalf("decoding node: %v", err)
+	}
+	if node.Value != float64(12345) {
+		t.Errorf("refresh changed Value to %v, want original 12345", node.Value)
+	}
+	if node.TTL != 30 {
+		t.Errorf("got TTL %d, want 30", node.TTL)
+	}
+}
+
+// TestCASPreconditions exercises the prevValue/prevIndex/prevExist
+// compare-and-swap parameters checkPrecondition enforces - the mechanism
+// that makes this store usable as a coordination primitive, not just a
+// key/value store.
+func TestCASPreconditions(t *testing.T) {
+	t.Run("prevValue mismatch on update fails with EcodeTestFailed", func(t *testing.T) {
+		cs := newTestServer()
+		w := doRequestQuery(cs, http.MethodPost, "child1/child2", "prevValue=nope", map[string]interface{}{"value": "new"})
+		if w.Code != http.StatusPreconditionFailed {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusPreconditionFailed)
+		}
+		if e := decodeError(t, w); e.Code != EcodeTestFailed {
+			t.Errorf("got errorCode %d, want %d", e.Code, EcodeTestFailed)
+		}
+	})
+
+	t.Run("matching prevValue on update succeeds", func(t *testing.T) {
+		cs := newTestServer()
+		w := doRequestQuery(cs, http.MethodPost, "child1/child2", "prevValue=12345", map[string]interface{}{"value": "new"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+	})
+
+	t.Run("prevIndex mismatch on update fails with EcodeTestFailed", func(t *testing.T) {
+		cs := newTestServer()
+		w := doRequestQuery(cs, http.MethodPost, "child1/child2", "prevIndex=999", map[string]interface{}{"value": "new"})
+		if w.Code != http.StatusPreconditionFailed {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusPreconditionFailed)
+		}
+		if e := decodeError(t, w); e.Code != EcodeTestFailed {
+			t.Errorf("got errorCode %d, want %d", e.Code, EcodeTestFailed)
+		}
+	})
+
+	t.Run("prevValue mismatch on delete fails with EcodeTestFailed", func(t *testing.T) {
+		cs := newTestServer()
+		w := doRequestQuery(cs, http.MethodDelete, "child1/child2", "prevValue=nope", nil)
+		if w.Code != http.StatusPreconditionFailed {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusPreconditionFailed)
+		}
+		if e := decodeError(t, w); e.Code != EcodeTestFailed {
+			t.Errorf("got errorCode %d, want %d", e.Code, EcodeTestFailed)
+		}
+	})
+
+	t.Run("prevExist=false against an existing key fails with EcodeNodeExist", func(t *testing.T) {
+		cs := newTestServer()
+		w := doRequestQuery(cs, http.MethodPut, "child1/child2", "prevExist=false", map[string]interface{}{"value": "new"})
+		if w.Code != http.StatusConflict {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusConflict)
+		}
+		if e := decodeError(t, w); e.Code != EcodeNodeExist {
+			t.Errorf("got errorCode %d, want %d", e.Code, EcodeNodeExist)
+		}
+	})
+
+	t.Run("prevExist=false against an existing directory fails with EcodeNotFile", func(t *testing.T) {
+		cs := newTestServer()
+		w := doRequestQuery(cs, http.MethodPut, "child1", "prevExist=false", map[string]interface{}{"value": "new"})
+		if w.Code != http.StatusConflict {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusConflict)
+		}
+		if e := decodeError(t, w); e.Code != EcodeNotFile {
+			t.Errorf("got errorCode %d, want %d", e.Code, EcodeNotFile)
+		}
+	})
+}
+
 func TestUpdate(t *testing.T) {
-	enc_child, _ := json.Marshal(test_child)
-	code := Create("child1/child2", bytes.NewReader(enc_child))
-	if code != http.StatusOK {
-		t.Fail()
+	cs := newTestServer()
+
+	w := doRequest(cs, http.MethodPost, "child1/child2", map[string]interface{}{"value": "updated"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	w = doRequest(cs, http.MethodGet, "child1/child2", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// Update requires the key to already exist.
+	w = doRequest(cs, http.MethodPost, "nosuchkey", map[string]interface{}{"value": "updated"})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if e := decodeError(t, w); e.Code != EcodeKeyNotFound {
+		t.Errorf("got errorCode %d, want %d", e.Code, EcodeKeyNotFound)
+	}
+}
+
+// statsIndex reads the server's current index via the same /v2/stats/self
+// handler a client would hit.
+func statsIndex(cs *ConfigServer) uint64 {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/v2/stats/self", nil)
+	cs.Stats(w, r, nil)
+
+	var stats statsResponse
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	return stats.Index
+}
+
+// waitForWatcherCount polls until n watchers are registered, failing the
+// test if that doesn't happen quickly - used to synchronize with a Watch
+// call running in its own goroutine before this goroutine mutates the
+// tree, so the mutation is guaranteed to happen after subscribe.
+func waitForWatcherCount(t *testing.T, cs *ConfigServer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		cs.watchMu.Lock()
+		count := len(cs.watchers)
+		cs.watchMu.Unlock()
+		if count >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d watcher(s) to register", n)
+}
+
+// TestWatchFanout checks that a watcher on an exact path is woken by a
+// matching mutation and sees the right action.
+func TestWatchFanout(t *testing.T) {
+	cs := newTestServer()
+
+	resultCh := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		resultCh <- doRequestQuery(cs, http.MethodGet, "child1/child2", "wait=true", nil)
+	}()
+	waitForWatcherCount(t, cs, 1)
+
+	doRequest(cs, http.MethodPost, "child1/child2", map[string]interface{}{"value": "new"})
+
+	select {
+	case w := <-resultCh:
+		var event Event
+		if err := json.Unmarshal(w.Body.Bytes(), &event); err != nil {
+			t.Fatalf("decoding event: %v", err)
+		}
+		if event.Action != ActionUpdate {
+			t.Errorf("got action %q, want %q", event.Action, ActionUpdate)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for watch event")
+	}
+}
+
+// TestWatchRecursive checks that a recursive watch on a directory is woken
+// by a mutation to a descendant, not just the watched path itself.
+func TestWatchRecursive(t *testing.T) {
+	cs := newTestServer()
+
+	resultCh := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		resultCh <- doRequestQuery(cs, http.MethodGet, "child1", "wait=true&recursive=true", nil)
+	}()
+	waitForWatcherCount(t, cs, 1)
+
+	doRequest(cs, http.MethodDelete, "child1/child2", nil)
+
+	select {
+	case w := <-resultCh:
+		var event Event
+		if err := json.Unmarshal(w.Body.Bytes(), &event); err != nil {
+			t.Fatalf("decoding event: %v", err)
+		}
+		if event.Action != ActionDelete {
+			t.Errorf("got action %q, want %q", event.Action, ActionDelete)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for watch event")
+	}
+}
+
+// TestWatchReplay checks that a waitIndex at or before an already-recorded
+// mutation replays it immediately instead of blocking.
+func TestWatchReplay(t *testing.T) {
+	cs := newTestServer()
+
+	doRequest(cs, http.MethodPost, "child1/child2", map[string]interface{}{"value": "new"})
+	idx := statsIndex(cs)
+
+	w := doRequestQuery(cs, http.MethodGet, "child1/child2", fmt.Sprintf("wait=true&waitIndex=%d", idx), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var event Event
+	if err := json.Unmarshal(w.Body.Bytes(), &event); err != nil {
+		t.Fatalf("decoding event: %v", err)
+	}
+	if event.Action != ActionUpdate {
+		t.Errorf("got action %q, want %q", event.Action, ActionUpdate)
+	}
+	if event.Node == nil || event.Node.ModifiedIndex != idx {
+		t.Errorf("got node %+v, want ModifiedIndex %d", event.Node, idx)
+	}
+}
+
+// syncRecorder is an http.ResponseWriter + http.Flusher safe to read from
+// one goroutine while the stream=true Watch loop writes from another -
+// unlike httptest.ResponseRecorder, whose Body is a plain bytes.Buffer.
+type syncRecorder struct {
+	mu     sync.Mutex
+	header http.Header
+	code   int
+	buf    bytes.Buffer
+	wrote  chan struct{}
+}
+
+func newSyncRecorder() *syncRecorder {
+	return &syncRecorder{header: make(http.Header), code: http.StatusOK, wrote: make(chan struct{}, 1)}
+}
+
+func (s *syncRecorder) Header() http.Header { return s.header }
+
+func (s *syncRecorder) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	n, err := s.buf.Write(p)
+	s.mu.Unlock()
+
+	select {
+	case s.wrote <- struct{}{}:
+	default:
+	}
+	return n, err
+}
+
+func (s *syncRecorder) WriteHeader(code int) {
+	s.mu.Lock()
+	s.code = code
+	s.mu.Unlock()
+}
+
+func (s *syncRecorder) Flush() {}
+
+func (s *syncRecorder) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Len()
+}
+
+// TestWatchStreamDisconnect checks that a stream=true watch notices the
+// client going away (r.Context().Done()) and unsubscribes, rather than
+// blocking in its range loop forever and leaking the watcher.
+func TestWatchStreamDisconnect(t *testing.T) {
+	cs := newTestServer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/v2/keys/child1/child2?wait=true&stream=true", nil).WithContext(ctx)
+	w := newSyncRecorder()
+	ps := httprouter.Params{{Key: "config", Value: "/child1/child2"}}
+
+	done := make(chan struct{})
+	go func() {
+		cs.Watch(w, r, ps)
+		close(done)
+	}()
+	waitForWatcherCount(t, cs, 1)
+
+	doRequest(cs, http.MethodPost, "child1/child2", map[string]interface{}{"value": "new"})
+
+	select {
+	case <-w.wrote:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the streamed event to be flushed")
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Watch did not return after the client disconnected")
+	}
+
+	cs.watchMu.Lock()
+	leaked := len(cs.watchers)
+	cs.watchMu.Unlock()
+	if leaked != 0 {
+		t.Errorf("got %d watchers still registered after disconnect, want 0", leaked)
+	}
+	if w.Len() == 0 {
+		t.Error("no event was ever written to the stream")
+	}
+}
+
+// TestWatchSlowWatcherDrops documents and pins down notify's behavior for
+// a watcher whose buffered channel is full: the mutation that triggered
+// the event must still succeed rather than block on a slow or stuck
+// client.
+func TestWatchSlowWatcherDrops(t *testing.T) {
+	cs := newTestServer()
+
+	_, ch, replayed := cs.replayOrSubscribe("child1/child2", false, 0, false)
+	if replayed {
+		t.Fatal("expected no replay for a fresh watcher")
+	}
+	defer cs.unsubscribe(ch)
+
+	for i := 0; i < cap(ch)+4; i++ {
+		w := doRequest(cs, http.MethodPost, "child1/child2", map[string]interface{}{"value": i})
+		if w.Code != http.StatusOK {
+			t.Fatalf("mutation %d: got status %d, want %d", i, w.Code, http.StatusOK)
+		}
+	}
+
+	if len(ch) != cap(ch) {
+		t.Errorf("got %d buffered events, want the channel capped at %d", len(ch), cap(ch))
+	}
+}
+
+// TestExpireOnce checks that a node created with a TTL is removed once its
+// expiration has passed and that a watcher sees an "expire" action - the
+// ephemeral-key pattern expireLoop exists for.
+func TestExpireOnce(t *testing.T) {
+	cs := newTestServer()
+
+	w := doRequestQuery(cs, http.MethodPut, "ephemeral", "ttl=1", map[string]interface{}{"value": "short-lived"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	_, ch, replayed := cs.replayOrSubscribe("ephemeral", false, 0, false)
+	if replayed {
+		t.Fatal("expected no replay for a fresh watcher")
+	}
+	defer cs.unsubscribe(ch)
+
+	cs.expireOnce(time.Now().Add(2 * time.Second))
+
+	w = doRequest(cs, http.MethodGet, "ephemeral", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("got status %d after expiration, want %d", w.Code, http.StatusNotFound)
 	}
 
-	_, code = Read("child1/child2")
-	if code != http.StatusOK {
-		t.Fail()
+	select {
+	case event := <-ch:
+		if event.Action != ActionExpire {
+			t.Errorf("got action %q, want %q", event.Action, ActionExpire)
+		}
+	default:
+		t.Fatal("expected an expire event to be delivered to the watcher")
 	}
 }
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	snapshotFileName = "snapshot.json"
+	walFileName      = "wal.log"
+)
+
+// mutationRecord is a single entry in the append-only write-ahead log.
+// Replaying every record in order, in index order, reproduces the tree.
+type mutationRecord struct {
+	Op        EventAction `json:"op"`
+	Path      string      `json:"path"`
+	Value     interface{} `json:"value,omitempty"`
+	TTL       int64       `json:"ttl,omitempty"`
+	Index     uint64      `json:"index"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// snapshotState is the full-tree checkpoint written to snapshotFileName.
+type snapshotState struct {
+	Root  *Node  `json:"root"`
+	Index uint64 `json:"index"`
+}
+
+// OpenStore points the server at dataDir and leaves it ready to keep
+// appending to the WAL. It must be called before Start. snapshotCount
+// controls how many mutations accumulate in the WAL before a fresh
+// snapshot is taken and the log is truncated.
+//
+// OpenStore itself does not populate Root - with raft enabled, whether
+// the application-level snapshot+WAL or raft's own durable log is the
+// right recovery source depends on whether this node already has raft
+// state, which only StartRaft knows. Call loadFromDisk explicitly (see
+// StartRaft) when that's the path to use.
+func (cs *ConfigServer) OpenStore(dataDir string, snapshotCount int) error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return fmt.Errorf("creating data dir: %w", err)
+	}
+
+	cs.dataDir = dataDir
+	cs.snapshotCount = snapshotCount
+
+	walFile, err := os.OpenFile(cs.walPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening WAL: %w", err)
+	}
+	cs.walFile = walFile
+
+	return nil
+}
+
+func (cs *ConfigServer) snapshotPath() string {
+	return filepath.Join(cs.dataDir, snapshotFileName)
+}
+
+func (cs *ConfigServer) walPath() string {
+	return filepath.Join(cs.dataDir, walFileName)
+}
+
+// loadFromDisk populates Root and index from the application-level
+// snapshot and WAL written by appendWAL/snapshotLocked. It is the
+// recovery path for a node with no raft-level durable state yet - a
+// fresh node, or one migrating from a pre-clustering deployment. Once
+// raft has its own persisted log and snapshot, raft's own Restore/Apply
+// replay is authoritative instead; calling both would double-apply the
+// same mutations.
+func (cs *ConfigServer) loadFromDisk() error {
+	if err := cs.loadSnapshot(); err != nil {
+		return fmt.Errorf("loading snapshot: %w", err)
+	}
+	if err := cs.replayWAL(); err != nil {
+		return fmt.Errorf("replaying WAL: %w", err)
+	}
+	cs.rebuildTTLEntriesLocked()
+	return nil
+}
+
+func (cs *ConfigServer) loadSnapshot() error {
+	data, err := os.ReadFile(cs.snapshotPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var state snapshotState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	cs.Root = state.Root
+	cs.index = state.Index
+	return nil
+}
+
+func (cs *ConfigServer) replayWAL() error {
+	file, err := os.Open(cs.walPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var record mutationRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		cs.applyRecordLocked(record)
+	}
+	return scanner.Err()
+}
+
+// applyRecordLocked replays a single WAL record directly against the
+// tree, bypassing notify/appendWAL since replay happens before the
+// server starts serving requests.
+func (cs *ConfigServer) applyRecordLocked(record mutationRecord) {
+	if record.Index > cs.index {
+		cs.index = record.Index
+	}
+
+	switch record.Op {
+	case ActionDelete, ActionExpire:
+		if record.Path == "" {
+			cs.Root = nil
+			return
+		}
+		parent, name := cs.splitPath(record.Path)
+		if parent != nil {
+			delete(parent.Children, name)
+		}
+	default: // create or update
+		node := &Node{Value: record.Value, Children: map[string]*Node{}}
+		applyTTL(node, time.Duration(record.TTL)*time.Second)
+		node.ModifiedIndex = record.Index
+		if record.Path == "" {
+			if cs.Root != nil {
+				node.CreatedIndex = cs.Root.CreatedIndex
+			} else {
+				node.CreatedIndex = record.Index
+			}
+			cs.Root = node
+			return
+		}
+		parent, name := cs.splitPath(record.Path)
+		if parent == nil {
+			return
+		}
+		if existing := parent.Children[name]; existing != nil {
+			node.CreatedIndex = existing.CreatedIndex
+		} else {
+			node.CreatedIndex = record.Index
+		}
+		parent.Children[name] = node
+	}
+}
+
+// splitPath walks to the parent of config, creating no nodes, returning
+// nil if the parent doesn't exist.
+func (cs *ConfigServer) splitPath(config string) (parent *Node, name string) {
+	dir, name := path.Split(config)
+	parent, err := cs.FindNode(dir)
+	if err != nil {
+		return nil, name
+	}
+	return parent, name
+}
+
+// appendWAL writes a single mutation record to the log and fsyncs it
+// before returning, so a record a caller has been told succeeded is
+// actually on disk if the process is killed or the machine loses power
+// right after. It returns an error if the write, the fsync, or a
+// snapshot triggered by snapshotCount fails - the caller mutated the
+// in-memory tree already, so a swallowed error here would mean a client
+// gets told 200 OK for a mutation that was never made durable, or a
+// torn trailing line that bricks replayWAL on the next restart. cs.mu
+// must be held by the caller, the same lock that mutated the tree, so
+// the log and the tree never diverge.
+//
+// Once raft is enabled it owns durability instead: its own bolt-backed
+// log and periodic FSM snapshot (see raft.go) already replay Apply in
+// order after a restart, so writing here too would just be dead I/O
+// racing raft's own snapshot compaction for no benefit.
+func (cs *ConfigServer) appendWAL(op EventAction, configPath string, value interface{}, ttl int64) error {
+	if cs.walFile == nil || cs.raft != nil {
+		return nil
+	}
+
+	record := mutationRecord{
+		Op:        op,
+		Path:      configPath,
+		Value:     value,
+		TTL:       ttl,
+		Index:     cs.index,
+		Timestamp: time.Now(),
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshaling WAL record: %w", err)
+	}
+	line = append(line, '\n')
+	if _, err := cs.walFile.Write(line); err != nil {
+		return fmt.Errorf("writing WAL record: %w", err)
+	}
+	if err := cs.walFile.Sync(); err != nil {
+		return fmt.Errorf("syncing WAL record: %w", err)
+	}
+
+	cs.mutationsSinceSnapshot++
+	if cs.snapshotCount > 0 && cs.mutationsSinceSnapshot >= cs.snapshotCount {
+		if err := cs.snapshotLocked(); err != nil {
+			return fmt.Errorf("snapshotting: %w", err)
+		}
+	}
+	return nil
+}
+
+// snapshotLocked writes a fresh snapshot.json and truncates the WAL.
+// cs.mu must be held by the caller.
+func (cs *ConfigServer) snapshotLocked() error {
+	if cs.dataDir == "" {
+		return nil
+	}
+
+	state := snapshotState{Root: cs.Root, Index: cs.index}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := cs.snapshotPath() + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, cs.snapshotPath()); err != nil {
+		return err
+	}
+
+	if cs.walFile != nil {
+		cs.walFile.Close()
+	}
+	walFile, err := os.OpenFile(cs.walPath(), os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	cs.walFile = walFile
+	cs.mutationsSinceSnapshot = 0
+
+	return nil
+}
+
+/*
+ * AdminSnapshot: forces an immediate snapshot + WAL truncation.
+ * takes:
+ *   nothing
+ * returns:
+ *   200 if successful
+ *   500 if the snapshot could not be written
+ */
+func (cs *ConfigServer) AdminSnapshot(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	cs.mu.Lock()
+	err := cs.snapshotLocked()
+	cs.mu.Unlock()
+
+	if err != nil {
+		cs.ErrorHandler(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
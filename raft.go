@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// raftApplyTimeout bounds how long a Create/Update/Delete waits for its
+// proposed log entry to commit before giving up.
+const raftApplyTimeout = 5 * time.Second
+
+// raftCommand is the log entry every mutation proposes. The FSM applies
+// committed commands in order, so precondition fields travel with the
+// command itself rather than being checked against local state before
+// proposing - two racing proposals must be resolved the same way on
+// every node.
+type raftCommand struct {
+	Op        EventAction `json:"op"`
+	Path      string      `json:"path"`
+	Value     interface{} `json:"value,omitempty"`
+	TTL       int64       `json:"ttl,omitempty"`
+	Refresh   bool        `json:"refresh,omitempty"`
+	PrevValue string      `json:"prevValue,omitempty"`
+	PrevIndex uint64      `json:"prevIndex,omitempty"`
+	PrevExist *bool       `json:"prevExist,omitempty"`
+}
+
+// applyResult is what applyCommand returns, translated back into an HTTP
+// response by the handler that proposed the command.
+type applyResult struct {
+	Node     *Node
+	PrevNode *Node
+	Index    uint64
+	Err      *Error
+}
+
+// fsm adapts ConfigServer to raft.FSM: Apply is the only place the tree
+// is mutated once clustering is enabled, so every node - leader and
+// followers alike - ends up with identical state and fires identical
+// watch events.
+type fsm ConfigServer
+
+func (f *fsm) cs() *ConfigServer { return (*ConfigServer)(f) }
+
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return &applyResult{Err: newError(EcodeRaftInternal, err.Error(), "")}
+	}
+	return f.cs().applyCommand(cmd)
+}
+
+// fsmSnapshot is the raft.FSMSnapshot counterpart to our own
+// snapshot.json - it lets raft truncate its log independently of the
+// application-level snapshotting in persist.go.
+type fsmSnapshot struct {
+	state snapshotState
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	cs := f.cs()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return &fsmSnapshot{state: snapshotState{Root: cs.Root, Index: cs.index}}, nil
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	if _, err := sink.Write(data); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+
+	var state snapshotState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	cs := f.cs()
+	cs.mu.Lock()
+	cs.Root = state.Root
+	cs.index = state.Index
+	cs.rebuildTTLEntriesLocked()
+	cs.mu.Unlock()
+	return nil
+}
+
+// peer describes another member of the cluster as given on the command
+// line: -peers id=raftAddr=httpAddr,id2=raftAddr2=httpAddr2
+type peer struct {
+	id       string
+	raftAddr string
+	httpAddr string
+}
+
+func parsePeers(spec string) ([]peer, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var peers []peer
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(entry, "=")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid -peers entry %q, want id=raftAddr=httpAddr", entry)
+		}
+		peers = append(peers, peer{id: parts[0], raftAddr: parts[1], httpAddr: parts[2]})
+	}
+	return peers, nil
+}
+
+// StartRaft brings up the raft subsystem: a single-node cluster
+// bootstraps itself immediately so the server is always usable, even
+// without -peers; peers passed on the command line are added as the
+// initial cluster configuration so every node agrees on membership
+// before any client traffic arrives.
+func (cs *ConfigServer) StartRaft(name, listenPeerURL string, peers []peer, dataDir string) error {
+	cs.name = name
+	cs.peerHTTP = map[raft.ServerAddress]string{}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(name)
+
+	addr, err := net.ResolveTCPAddr("tcp", listenPeerURL)
+	if err != nil {
+		return fmt.Errorf("resolving -listen-peer-urls: %w", err)
+	}
+	transport, err := raft.NewTCPTransport(listenPeerURL, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("creating raft transport: %w", err)
+	}
+
+	raftDir := filepath.Join(dataDir, "raft")
+	if err := os.MkdirAll(raftDir, 0755); err != nil {
+		return err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(raftDir, 2, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("creating raft snapshot store: %w", err)
+	}
+
+	// A bolt-backed log and stable store so raft's own state - unlike the
+	// in-memory stores raft.NewInmemStore returns - survives a restart.
+	// Without this, HasExistingState below always reports false and every
+	// restart re-bootstraps into a fresh single-node configuration instead
+	// of rejoining the one already agreed on.
+	boltStore, err := raftboltdb.New(raftboltdb.Options{Path: filepath.Join(raftDir, "raft.db")})
+	if err != nil {
+		return fmt.Errorf("creating raft log store: %w", err)
+	}
+	var logStore raft.LogStore = boltStore
+	var stableStore raft.StableStore = boltStore
+
+	// Whether this node already has raft-level durable state decides the
+	// recovery path: with existing state, raft.NewRaft below restores Root
+	// itself (via fsm.Restore and replaying its own log), so loading the
+	// application-level snapshot+WAL here would double-apply every
+	// mutation. Without it, raft starts empty and needs the
+	// application-level state - if any - as its initial FSM state.
+	hasState, err := raft.HasExistingState(logStore, stableStore, snapshots)
+	if err != nil {
+		return err
+	}
+	if !hasState {
+		if err := cs.loadFromDisk(); err != nil {
+			return fmt.Errorf("loading application-level state: %w", err)
+		}
+	}
+
+	fsm := (*fsm)(cs)
+	r, err := raft.NewRaft(config, fsm, logStore, stableStore, snapshots, transport)
+	if err != nil {
+		return fmt.Errorf("creating raft node: %w", err)
+	}
+	cs.raft = r
+
+	servers := []raft.Server{{ID: config.LocalID, Address: transport.LocalAddr()}}
+	for _, p := range peers {
+		servers = append(servers, raft.Server{ID: raft.ServerID(p.id), Address: raft.ServerAddress(p.raftAddr)})
+		cs.peerHTTP[raft.ServerAddress(p.raftAddr)] = p.httpAddr
+	}
+	if !hasState {
+		r.BootstrapCluster(raft.Configuration{Servers: servers})
+	}
+
+	return nil
+}
+
+// redirectToLeader forwards a write a follower can't service to the
+// current leader's HTTP address, mirroring etcd's redirect-to-leader
+// behavior for clients that aren't cluster-aware.
+func (cs *ConfigServer) redirectToLeader(w http.ResponseWriter, r *http.Request) {
+	leaderAddr := cs.raft.Leader()
+	if leaderAddr == "" {
+		cs.ErrorHandler(w, http.StatusServiceUnavailable, fmt.Errorf("no leader elected"))
+		return
+	}
+
+	cs.mu.Lock()
+	httpAddr, ok := cs.peerHTTP[leaderAddr]
+	cs.mu.Unlock()
+	if !ok {
+		cs.ErrorHandler(w, http.StatusServiceUnavailable, fmt.Errorf("unknown leader %s", leaderAddr))
+		return
+	}
+
+	target := "http://" + httpAddr + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+}
+
+// propose applies cmd through raft and waits for it to commit. If this
+// node isn't the leader the caller should redirect instead of treating
+// this as a hard failure.
+func (cs *ConfigServer) propose(cmd raftCommand) (*applyResult, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	future := cs.raft.Apply(data, raftApplyTimeout)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	result, _ := future.Response().(*applyResult)
+	return result, nil
+}
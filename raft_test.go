@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// newInmemRaftNode builds a ConfigServer backed by a real raft.Raft using
+// in-memory transport/log/stable/snapshot stores - no TCP listeners or
+// disk I/O, so several can run side by side in one test process.
+func newInmemRaftNode(t *testing.T, id string) (*ConfigServer, *raft.InmemTransport) {
+	t.Helper()
+
+	cs := &ConfigServer{Root: &Node{Children: map[string]*Node{}}}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(id)
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 25 * time.Millisecond
+	config.CommitTimeout = 5 * time.Millisecond
+	config.LogOutput = io.Discard
+
+	_, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+
+	fsm := (*fsm)(cs)
+	r, err := raft.NewRaft(config, fsm, raft.NewInmemStore(), raft.NewInmemStore(), raft.NewInmemSnapshotStore(), transport)
+	if err != nil {
+		t.Fatalf("NewRaft(%s): %v", id, err)
+	}
+	cs.raft = r
+
+	return cs, transport
+}
+
+// waitForLeader polls servers until exactly one reports itself as raft
+// leader, failing the test if none does before the deadline.
+func waitForLeader(t *testing.T, servers []*ConfigServer) *ConfigServer {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, cs := range servers {
+			if cs.raft.State() == raft.Leader {
+				return cs
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("no leader elected before deadline")
+	return nil
+}
+
+// waitForValue polls cs's tree until config reads back as want, failing
+// the test if it hasn't replicated before the deadline.
+func waitForValue(t *testing.T, cs *ConfigServer, config string, want interface{}) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		w := doRequest(cs, http.MethodGet, config, nil)
+		if w.Code == http.StatusOK {
+			if node := decodeNode(t, w); node.Value == want {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("%s never replicated to follower", config)
+}
+
+// TestRaftClusterReplicatesWrites runs three ConfigServers through a real
+// raft.Raft cluster (in-memory transport and stores) and checks that a
+// write accepted by the leader's FSM.Apply shows up on a follower - the
+// core promise the clustering work exists for.
+func TestRaftClusterReplicatesWrites(t *testing.T) {
+	ids := []string{"node1", "node2", "node3"}
+	servers := make([]*ConfigServer, len(ids))
+	transports := make([]*raft.InmemTransport, len(ids))
+	for i, id := range ids {
+		servers[i], transports[i] = newInmemRaftNode(t, id)
+	}
+	for i := range servers {
+		for j := range servers {
+			if i != j {
+				transports[i].Connect(raft.ServerAddress(ids[j]), transports[j])
+			}
+		}
+	}
+
+	var raftServers []raft.Server
+	for _, id := range ids {
+		raftServers = append(raftServers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(id)})
+	}
+	if err := servers[0].raft.BootstrapCluster(raft.Configuration{Servers: raftServers}).Error(); err != nil {
+		t.Fatalf("BootstrapCluster: %v", err)
+	}
+
+	leader := waitForLeader(t, servers)
+
+	w := doRequest(leader, http.MethodPut, "a", map[string]interface{}{"value": "one"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("create a on leader: got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	for _, cs := range servers {
+		if cs == leader {
+			continue
+		}
+		waitForValue(t, cs, "a", "one")
+	}
+}
+
+// TestParsePeers checks the id=raftAddr=httpAddr spec parsing that feeds
+// -peers on the command line.
+func TestParsePeers(t *testing.T) {
+	if peers, err := parsePeers(""); err != nil || peers != nil {
+		t.Fatalf("parsePeers(\"\") = %v, %v, want nil, nil", peers, err)
+	}
+
+	peers, err := parsePeers("node2=127.0.0.1:9001=127.0.0.1:8081,node3=127.0.0.1:9002=127.0.0.1:8082")
+	if err != nil {
+		t.Fatalf("parsePeers: %v", err)
+	}
+	want := []peer{
+		{id: "node2", raftAddr: "127.0.0.1:9001", httpAddr: "127.0.0.1:8081"},
+		{id: "node3", raftAddr: "127.0.0.1:9002", httpAddr: "127.0.0.1:8082"},
+	}
+	if len(peers) != len(want) {
+		t.Fatalf("got %d peers, want %d", len(peers), len(want))
+	}
+	for i := range want {
+		if peers[i] != want[i] {
+			t.Errorf("peer %d: got %+v, want %+v", i, peers[i], want[i])
+		}
+	}
+
+	if _, err := parsePeers("node2=127.0.0.1:9001"); err == nil {
+		t.Error("expected an error for a malformed -peers entry, got nil")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/hashicorp/raft"
+	"github.com/julienschmidt/httprouter"
+)
+
+// buildRouter wires up every route the server exposes. It replaces the
+// old single catch-all Handle switch: the tree CRUD lives under
+// /v2/keys, server introspection under /v2/stats, snapshot/health
+// administration under /v2/admin, and cluster membership (for the
+// clustering work this is a prerequisite for) under /v2/members.
+func (cs *ConfigServer) buildRouter() *httprouter.Router {
+	router := httprouter.New()
+
+	router.PUT("/v2/keys/*config", withMiddleware(cs.Create))
+	router.GET("/v2/keys/*config", withMiddleware(cs.Read))
+	router.POST("/v2/keys/*config", withMiddleware(cs.Update))
+	router.DELETE("/v2/keys/*config", withMiddleware(cs.Delete))
+
+	router.GET("/v2/stats/self", withMiddleware(cs.Stats))
+
+	router.POST("/v2/admin/snapshot", withMiddleware(cs.AdminSnapshot))
+
+	router.GET("/v2/members", withMiddleware(cs.Members))
+	router.POST("/v2/members", withMiddleware(cs.AddMember))
+	router.DELETE("/v2/members/:id", withMiddleware(cs.RemoveMember))
+
+	return router
+}
+
+// withMiddleware wraps a route handler with the logging and panic
+// recovery behavior every route should get, replacing the ad-hoc
+// log.Printf and ErrorHandler calls handlers used to do themselves.
+func withMiddleware(h httprouter.Handle) httprouter.Handle {
+	return recoveryMiddleware(loggingMiddleware(h))
+}
+
+func loggingMiddleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		log.Printf("%s %s", r.Method, r.URL)
+		next(w, r, ps)
+	}
+}
+
+func recoveryMiddleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("panic handling %s %s: %v", r.Method, r.URL, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+			}
+		}()
+		next(w, r, ps)
+	}
+}
+
+// statsResponse is the payload served from /v2/stats/self.
+type statsResponse struct {
+	Index uint64 `json:"index"`
+}
+
+/*
+ * Stats: reports basic server state.
+ * takes:
+ *   nothing
+ * returns:
+ *   200 with a JSON statsResponse
+ */
+func (cs *ConfigServer) Stats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	cs.mu.Lock()
+	index := cs.index
+	cs.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statsResponse{Index: index})
+}
+
+// memberInfo is one entry in the /v2/members listing.
+type memberInfo struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raftAddr"`
+	HTTPAddr string `json:"httpAddr,omitempty"`
+	Leader   bool   `json:"leader"`
+}
+
+/*
+ * Members: lists the cluster membership as seen by raft. A standalone
+ * server (cs.raft == nil, e.g. in tests) reports itself as the sole
+ * member.
+ * takes:
+ *   nothing
+ * returns:
+ *   200 with a JSON {"members": [...]}
+ *   503 if the raft configuration can't be read
+ */
+func (cs *ConfigServer) Members(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if cs.raft == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"members": []interface{}{map[string]string{"name": "self"}},
+		})
+		return
+	}
+
+	future := cs.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		cs.ErrorHandler(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	leader := cs.raft.Leader()
+	cs.mu.Lock()
+	members := make([]memberInfo, 0, len(future.Configuration().Servers))
+	for _, server := range future.Configuration().Servers {
+		members = append(members, memberInfo{
+			ID:       string(server.ID),
+			RaftAddr: string(server.Address),
+			HTTPAddr: cs.peerHTTP[server.Address],
+			Leader:   server.Address == leader,
+		})
+	}
+	cs.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"members": members})
+}
+
+// addMemberRequest is the body POSTed to /v2/members to add a voter.
+type addMemberRequest struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raftAddr"`
+	HTTPAddr string `json:"httpAddr"`
+}
+
+/*
+ * AddMember: adds a new voting member to the raft cluster, mirroring
+ * etcd's member-add API. Only the leader can service this; followers
+ * redirect.
+ * takes:
+ *   JSON body: {"id", "raftAddr", "httpAddr"}
+ * returns:
+ *   200 if successful
+ *   400 if the body is malformed
+ *   503 if this server doesn't cluster or the add fails
+ */
+func (cs *ConfigServer) AddMember(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if cs.raft == nil {
+		cs.ErrorHandler(w, http.StatusServiceUnavailable, fmt.Errorf("clustering not enabled"))
+		return
+	}
+	if cs.raft.State() != raft.Leader {
+		cs.redirectToLeader(w, r)
+		return
+	}
+
+	var req addMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		cs.ErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	future := cs.raft.AddVoter(raft.ServerID(req.ID), raft.ServerAddress(req.RaftAddr), 0, 0)
+	if err := future.Error(); err != nil {
+		cs.ErrorHandler(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	cs.mu.Lock()
+	cs.peerHTTP[raft.ServerAddress(req.RaftAddr)] = req.HTTPAddr
+	cs.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+ * RemoveMember: removes a voting member from the raft cluster, mirroring
+ * etcd's member-delete API. Only the leader can service this; followers
+ * redirect.
+ * takes:
+ *   URI path segment :id identifies the member's raft server ID
+ * returns:
+ *   200 if successful
+ *   503 if this server doesn't cluster or the removal fails
+ */
+func (cs *ConfigServer) RemoveMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if cs.raft == nil {
+		cs.ErrorHandler(w, http.StatusServiceUnavailable, fmt.Errorf("clustering not enabled"))
+		return
+	}
+	if cs.raft.State() != raft.Leader {
+		cs.redirectToLeader(w, r)
+		return
+	}
+
+	future := cs.raft.RemoveServer(raft.ServerID(ps.ByName("id")), 0, 0)
+	if err := future.Error(); err != nil {
+		cs.ErrorHandler(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}